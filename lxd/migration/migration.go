@@ -0,0 +1,159 @@
+// Package migration describes the wire-level shape of a storage migration
+// independent of any container concept. lxd's container migration builds on
+// top of MigrationVolume/VolumeSourceArgs/VolumeTargetArgs to move a
+// container's rootfs, and the same types describe a bare custom storage
+// volume with no container wrapping it at all just as well - lxd.MigrateVolume
+// and lxd.ReceiveVolume send and receive one using exactly this package's
+// types. That's transport plumbing, not the feature itself: this tree has
+// no API route or CLI command that calls them, so
+// `lxc storage volume copy remote:pool/vol local:pool/vol` doesn't work yet.
+package migration
+
+// FSType identifies the on-disk transport a migration source or sink is
+// able to speak for a given volume.
+type FSType int
+
+const (
+	FSTypeRsync FSType = iota
+	FSTypeBtrfs
+	FSTypeZfs
+)
+
+// Type pairs a transport with the set of optional features the endpoint
+// advertising it supports, e.g. a btrfs send/receive pair might support
+// "xattrs" but not "compress". BwlimitBytesPerSecond is a per-migration
+// tunable rather than a negotiated capability, but it travels alongside the
+// transport choice since every transport implementation needs it.
+type Type struct {
+	FSType                FSType
+	Features              []string
+	BwlimitBytesPerSecond int64
+}
+
+// HasFeature reports whether both ends agreed to use the named feature for
+// this transport (e.g. "compress").
+func (t Type) HasFeature(name string) bool {
+	for _, f := range t.Features {
+		if f == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MigrationVolume describes a storage volume and its snapshots as they
+// travel over a migration connection. It carries no container-specific
+// state (idmap, root disk device, stateful checkpoint) - that belongs to
+// the caller layering container semantics on top.
+type MigrationVolume struct {
+	Name      string
+	Snapshots []string
+}
+
+// VolumeSourceArgs are the arguments needed to send a MigrationVolume
+// across a migration connection using the negotiated Type.
+type VolumeSourceArgs struct {
+	Name          string
+	Snapshots     []string
+	MigrationType Type
+
+	// Fingerprints lists, oldest first, the image and snapshot
+	// fingerprints this volume was derived from. The sink matches these
+	// against what it already has locally (see PickSeed) and seeds its
+	// own copy from the most recent common ancestor before the transfer;
+	// nothing about that choice is sent back to the source.
+	Fingerprints []string
+
+	// ResumeSkip lists snapshot/rootfs names the sink already received
+	// in full during an earlier, dropped attempt at this same
+	// migration; the source omits those snapshots entirely on retry, and
+	// always resends the rootfs. The one name the sink had partially
+	// received (if any) is resent in full; no partial-transfer resume is
+	// done.
+	ResumeSkip []string
+}
+
+// Volume returns the MigrationVolume these VolumeSourceArgs describe.
+func (a VolumeSourceArgs) Volume() MigrationVolume {
+	return MigrationVolume{Name: a.Name, Snapshots: a.Snapshots}
+}
+
+// VolumeTargetArgs are the arguments needed to receive a MigrationVolume
+// from a migration connection using the negotiated Type.
+type VolumeTargetArgs struct {
+	Name          string
+	Snapshots     []string
+	MigrationType Type
+
+	// Refresh is true when the sink already holds an earlier copy of
+	// this volume (e.g. a previous migration or snapshot) and only
+	// needs the delta since Fingerprints' chosen seed.
+	Refresh bool
+}
+
+// Volume returns the MigrationVolume these VolumeTargetArgs describe.
+func (a VolumeTargetArgs) Volume() MigrationVolume {
+	return MigrationVolume{Name: a.Name, Snapshots: a.Snapshots}
+}
+
+// PickSeed returns the best common fingerprint between what the source
+// offers and what the sink already has cached locally, preferring the most
+// recently derived one since it minimizes the remaining diff. ok is false
+// if the two share no common ancestor, meaning the sink has nothing to seed
+// from and needs the volume sent in full.
+func PickSeed(sourceFingerprints []string, localFingerprints []string) (fingerprint string, ok bool) {
+	local := make(map[string]bool, len(localFingerprints))
+	for _, fp := range localFingerprints {
+		local[fp] = true
+	}
+
+	for i := len(sourceFingerprints) - 1; i >= 0; i-- {
+		if local[sourceFingerprints[i]] {
+			return sourceFingerprints[i], true
+		}
+	}
+
+	return "", false
+}
+
+// MatchTypes intersects the source's and sink's advertised Types and
+// returns the first of the sink's Types, in the sink's order of preference,
+// that the source also offers, along with the set of features both ends
+// agree on for it. A sink that lists its native send/receive transport
+// before rsync thus gets the native one whenever the source offers it. BwlimitBytesPerSecond is carried over from the sink's Type rather
+// than intersected like Features, since the sink is authoritative over the
+// migration's transport configuration as a whole.
+func MatchTypes(source []Type, sink []Type) (Type, bool) {
+	for _, sinkType := range sink {
+		for _, sourceType := range source {
+			if sinkType.FSType != sourceType.FSType {
+				continue
+			}
+
+			return Type{
+				FSType:                sinkType.FSType,
+				Features:              intersectFeatures(sourceType.Features, sinkType.Features),
+				BwlimitBytesPerSecond: sinkType.BwlimitBytesPerSecond,
+			}, true
+		}
+	}
+
+	return Type{}, false
+}
+
+func intersectFeatures(a []string, b []string) []string {
+	bSet := make(map[string]bool, len(b))
+	for _, f := range b {
+		bSet[f] = true
+	}
+
+	features := []string{}
+	for _, f := range a {
+		if bSet[f] {
+			features = append(features, f)
+		}
+	}
+
+	return features
+}
@@ -0,0 +1,75 @@
+package migration
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchTypesPrefersNativeFSTypeAndIntersectsFeatures(t *testing.T) {
+	source := []Type{
+		{FSType: FSTypeBtrfs, Features: []string{"xattrs", "delete"}},
+		{FSType: FSTypeRsync, Features: []string{"xattrs", "delete", "compress"}},
+	}
+	sink := []Type{
+		{FSType: FSTypeBtrfs, Features: []string{"delete", "compress"}},
+		{FSType: FSTypeRsync, Features: []string{"xattrs", "delete", "compress"}},
+	}
+
+	got, ok := MatchTypes(source, sink)
+	if !ok {
+		t.Fatalf("expected a match")
+	}
+
+	if got.FSType != FSTypeBtrfs {
+		t.Fatalf("got FSType %v, want %v", got.FSType, FSTypeBtrfs)
+	}
+
+	if !reflect.DeepEqual(got.Features, []string{"delete"}) {
+		t.Fatalf("got Features %v, want [delete]", got.Features)
+	}
+}
+
+func TestMatchTypesNoCommonFSType(t *testing.T) {
+	source := []Type{{FSType: FSTypeZfs}}
+	sink := []Type{{FSType: FSTypeBtrfs}}
+
+	_, ok := MatchTypes(source, sink)
+	if ok {
+		t.Fatalf("expected no match")
+	}
+}
+
+func TestMatchTypesCarriesSinkBwlimit(t *testing.T) {
+	source := []Type{{FSType: FSTypeRsync, BwlimitBytesPerSecond: 999}}
+	sink := []Type{{FSType: FSTypeRsync, BwlimitBytesPerSecond: 1024}}
+
+	got, ok := MatchTypes(source, sink)
+	if !ok {
+		t.Fatalf("expected a match")
+	}
+
+	if got.BwlimitBytesPerSecond != 1024 {
+		t.Fatalf("got BwlimitBytesPerSecond %d, want the sink's 1024", got.BwlimitBytesPerSecond)
+	}
+}
+
+func TestPickSeedPrefersMostRecentCommonFingerprint(t *testing.T) {
+	source := []string{"image-abc", "snap-1", "snap-2", "snap-3"}
+	local := []string{"snap-1", "snap-2"}
+
+	got, ok := PickSeed(source, local)
+	if !ok {
+		t.Fatalf("expected a common fingerprint")
+	}
+
+	if got != "snap-2" {
+		t.Fatalf("got %q, want snap-2 (the most recent common fingerprint)", got)
+	}
+}
+
+func TestPickSeedNoCommonAncestor(t *testing.T) {
+	_, ok := PickSeed([]string{"image-abc"}, []string{"image-def"})
+	if ok {
+		t.Fatalf("expected no common fingerprint")
+	}
+}
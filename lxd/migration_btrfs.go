@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// btrfsMigrationSourceDriver streams btrfs subvolumes natively via
+// `btrfs send`/`btrfs receive` instead of rsync. SendWhileRunning sends a
+// full stream from a base snapshot taken up-front; SendAfterCheckpoint
+// sends an incremental `-p` delta from that same snapshot.
+type btrfsMigrationSourceDriver struct {
+	container       container
+	snapshots       []container
+	btrfs           *storageBtrfs
+	migrationType   MigrationType
+	runningSnapPath string
+	stoppedSnapPath string
+
+	// resumeSkip lists snapshot names the sink already received in full
+	// during an earlier, dropped attempt at this same migration; they're
+	// omitted here to match the sink's own skip in migration_btrfs.go.
+	resumeSkip []string
+}
+
+func (s *btrfsMigrationSourceDriver) Snapshots() []container {
+	return s.snapshots
+}
+
+func (s *btrfsMigrationSourceDriver) SendWhileRunning(conn *websocket.Conn, op *operation) error {
+	skip := make(map[string]bool, len(s.resumeSkip))
+	for _, name := range s.resumeSkip {
+		skip[name] = true
+	}
+
+	for _, snap := range s.snapshots {
+		if skip[snap.Name()] {
+			continue
+		}
+
+		wrapper := StorageProgressReader(op, "fs_progress", snap.Name())
+		if err := s.send(conn, snap.Path(), "", wrapper); err != nil {
+			return err
+		}
+	}
+
+	// Take a read-only snapshot of the container so the post-checkpoint
+	// send in SendAfterCheckpoint has a stable base to diff against.
+	snapshotPath := getSnapshotMountPoint(s.btrfs.pool.Name, fmt.Sprintf("%s/migration-send", s.container.Name()))
+	if err := s.btrfs.subvolSnapshot(s.container.Path(), snapshotPath, true); err != nil {
+		return err
+	}
+	s.runningSnapPath = snapshotPath
+
+	wrapper := StorageProgressReader(op, "fs_progress", s.container.Name())
+	return s.send(conn, snapshotPath, "", wrapper)
+}
+
+// SendAfterCheckpoint is idempotent: on a retried migration (e.g. after a
+// dropped WAN connection) it may be called again for the same checkpoint,
+// so any snapshot left over from a prior attempt is cleared first rather
+// than erroring out on a name collision.
+func (s *btrfsMigrationSourceDriver) SendAfterCheckpoint(conn *websocket.Conn) error {
+	snapshotPath := getSnapshotMountPoint(s.btrfs.pool.Name, fmt.Sprintf("%s/migration-send-final", s.container.Name()))
+	s.btrfs.subvolsDelete(snapshotPath)
+	if err := s.btrfs.subvolSnapshot(s.container.Path(), snapshotPath, true); err != nil {
+		return err
+	}
+	s.stoppedSnapPath = snapshotPath
+
+	return s.send(conn, snapshotPath, s.runningSnapPath, nil)
+}
+
+func (s *btrfsMigrationSourceDriver) Cleanup() {
+	if s.runningSnapPath != "" {
+		s.btrfs.subvolsDelete(s.runningSnapPath)
+	}
+
+	if s.stoppedSnapPath != "" {
+		s.btrfs.subvolsDelete(s.stoppedSnapPath)
+	}
+}
+
+// send pipes `btrfs send [-p parent] path` into conn, optionally as an
+// incremental stream relative to parent.
+func (s *btrfsMigrationSourceDriver) send(conn *websocket.Conn, path string, parent string, wrapper func(io.ReadCloser) io.ReadCloser) error {
+	args := []string{"send"}
+	if parent != "" {
+		args = append(args, "-p", parent)
+	}
+	args = append(args, path)
+
+	cmd := exec.Command("btrfs", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var reader io.ReadCloser = stdout
+	if wrapper != nil {
+		reader = wrapper(stdout)
+	}
+
+	if err := migrationSendFile(conn, reader, s.migrationType); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	return cmd.Wait()
+}
+
+func btrfsMigrationSource(c container, snapshots []container, migrationType MigrationType, resumeSkip []string) (MigrationStorageSourceDriver, error) {
+	btrfs, ok := c.Storage().(*storageBtrfs)
+	if !ok {
+		return nil, fmt.Errorf("Container is not backed by a btrfs pool")
+	}
+
+	return &btrfsMigrationSourceDriver{container: c, snapshots: snapshots, btrfs: btrfs, migrationType: migrationType, resumeSkip: resumeSkip}, nil
+}
+
+// btrfsMigrationSinkDriver lays out incoming snapshots as btrfs subvolumes
+// when the negotiated transport is native send/receive, and otherwise
+// defers to the generic rsync layout used by backends with no native
+// send/receive support.
+type btrfsMigrationSinkDriver struct{}
+
+func (btrfsMigrationSinkDriver) CreateVolumeFromMigration(live bool, container container, snapshots []*Snapshot, parentStoragePool string, migrationType MigrationType, conn *websocket.Conn, srcIdmap *shared.IdmapSet, progress *migrationProgressState, op *operation) error {
+	if migrationType.FSType != MigrationFSType_BTRFS {
+		return genericMigrationSinkDriver{}.CreateVolumeFromMigration(live, container, snapshots, parentStoragePool, migrationType, conn, srcIdmap, progress, op)
+	}
+
+	btrfs, ok := container.Storage().(*storageBtrfs)
+	if !ok {
+		return fmt.Errorf("Container is not backed by a btrfs pool")
+	}
+
+	for _, snap := range snapshots {
+		if progress.isComplete(snap.GetName()) {
+			continue
+		}
+
+		args := snapshotProtobufToContainerArgs(container.Name(), snap)
+		assignSnapshotStoragePool(args, parentStoragePool)
+
+		s, err := containerCreateEmptySnapshot(container.Daemon(), args)
+		if err != nil {
+			return err
+		}
+
+		progress.markInflight(container.Name(), snap.GetName())
+		wrapper := StorageProgressWriter(op, "fs_progress", s.Name())
+		if err := btrfsMigrationSink(conn, btrfs, s.Path(), migrationType, wrapper); err != nil {
+			return err
+		}
+		progress.markComplete(container.Name(), snap.GetName())
+
+		if err := ShiftIfNecessary(container, srcIdmap); err != nil {
+			return err
+		}
+	}
+
+	progress.markInflight(container.Name(), container.Name())
+	wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
+	if err := btrfsMigrationSink(conn, btrfs, container.Path(), migrationType, wrapper); err != nil {
+		return err
+	}
+
+	if live {
+		// SendAfterCheckpoint sent an incremental `btrfs send -p` delta
+		// relative to the snapshot the full stream above just landed at
+		// container.Path(). btrfsMigrationSink's receive call is the same
+		// one regardless of whether the stream is a full or incremental
+		// image - `btrfs receive` resolves the parent by the UUID
+		// embedded in the stream, which it finds because the prior call
+		// just placed it at container.Path() - and it renames whatever
+		// subvolume comes out onto container.Path() again, so this call
+		// really does apply the delta in place rather than repeating the
+		// full receive.
+		wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
+		if err := btrfsMigrationSink(conn, btrfs, container.Path(), migrationType, wrapper); err != nil {
+			return err
+		}
+	}
+
+	progress.markComplete(container.Name(), container.Name())
+	return ShiftIfNecessary(container, srcIdmap)
+}
+
+// btrfsMigrationSink receives into destContainerPath's parent directory -
+// `btrfs receive` always names the subvolume it creates after the one the
+// stream was sent from, which won't generally match destContainerPath's own
+// basename - and then renames whatever subvolume came out of that onto
+// destContainerPath, replacing anything already there. Since destContainerPath
+// is itself a btrfs subvolume (e.g. left over from an earlier receive onto
+// the same path), it has to be torn down with btrfs's own subvolsDelete
+// rather than a plain file removal, which the kernel rejects for subvolumes.
+func btrfsMigrationSink(conn *websocket.Conn, btrfs *storageBtrfs, destContainerPath string, migrationType MigrationType, wrapper func(io.WriteCloser) io.WriteCloser) error {
+	parentDir := filepath.Dir(destContainerPath)
+
+	cmd := exec.Command("btrfs", "receive", "-e", parentDir)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var writer io.WriteCloser = stdin
+	if wrapper != nil {
+		writer = wrapper(stdin)
+	}
+
+	if err := migrationRecvFile(conn, writer, migrationType); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	writer.Close()
+	if err := cmd.Wait(); err != nil {
+		return err
+	}
+
+	receivedName := parseBtrfsReceivedSubvolume(stdout.String())
+	if receivedName == "" {
+		return fmt.Errorf("Could not determine the subvolume name received by btrfs receive")
+	}
+
+	receivedPath := filepath.Join(parentDir, receivedName)
+	if receivedPath == destContainerPath {
+		return nil
+	}
+
+	if shared.PathExists(destContainerPath) {
+		if err := btrfs.subvolsDelete(destContainerPath); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(receivedPath, destContainerPath)
+}
+
+// parseBtrfsReceivedSubvolume extracts the subvolume name `btrfs receive`
+// reports on stdout, e.g. "At subvol migration-send" for a full stream or
+// "At snapshot migration-send-final" for an incremental one.
+func parseBtrfsReceivedSubvolume(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		for _, prefix := range []string{"At subvol ", "At snapshot "} {
+			if strings.HasPrefix(line, prefix) {
+				return strings.TrimSpace(strings.TrimPrefix(line, prefix))
+			}
+		}
+	}
+
+	return ""
+}
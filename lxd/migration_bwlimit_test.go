@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestNewBwlimitWriterNoLimitReturnsWriterUnchanged(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := newBwlimitWriter(&buf, 0)
+	if w != io.Writer(&buf) {
+		t.Fatalf("expected newBwlimitWriter to return the underlying writer unchanged when bytesPerSecond is 0")
+	}
+}
+
+func TestBwlimitWriterWritesAllBytes(t *testing.T) {
+	var buf bytes.Buffer
+
+	w := newBwlimitWriter(&buf, 1024*1024)
+	payload := bytes.Repeat([]byte("x"), 4096)
+
+	n, err := w.Write(payload)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if n != len(payload) {
+		t.Fatalf("got %d bytes written, want %d", n, len(payload))
+	}
+
+	if !bytes.Equal(buf.Bytes(), payload) {
+		t.Fatalf("bwlimitWriter altered the byte stream")
+	}
+}
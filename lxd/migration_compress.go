@@ -0,0 +1,98 @@
+package main
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// maybeCompressWriter wraps w in a zstd encoder when compress is true,
+// negotiated up-front via the migration header so both ends agree on it;
+// otherwise it returns w as a no-op WriteCloser.
+func maybeCompressWriter(w io.Writer, compress bool) (io.WriteCloser, error) {
+	if !compress {
+		return nopWriteCloser{w}, nil
+	}
+
+	return zstd.NewWriter(w)
+}
+
+// maybeDecompressReader is the receive-side counterpart to
+// maybeCompressWriter.
+func maybeDecompressReader(r io.Reader, compress bool) (io.Reader, error) {
+	if !compress {
+		return r, nil
+	}
+
+	zr, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return zr.IOReadCloser(), nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// maybeCompressReader is the rsync-side counterpart to maybeCompressWriter:
+// RsyncSend only gives callers a hook to wrap the local reader it sends
+// from, not the writer side of the connection, so compression has to be
+// applied there instead, via a pipe running the encoder in the background.
+func maybeCompressReader(r io.ReadCloser, compress bool) io.ReadCloser {
+	if !compress {
+		return r
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		enc, err := zstd.NewWriter(pw)
+		if err != nil {
+			r.Close()
+			pw.CloseWithError(err)
+			return
+		}
+
+		_, err = io.Copy(enc, r)
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+
+		r.Close()
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+// maybeDecompressWriter is the rsync-side counterpart to
+// maybeDecompressReader: RsyncRecv only gives callers a hook to wrap the
+// local writer it receives into, not the reader side of the connection, so
+// decompression has to be applied there instead, via a pipe running the
+// decoder in the background.
+func maybeDecompressWriter(w io.WriteCloser, compress bool) io.WriteCloser {
+	if !compress {
+		return w
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		dec, err := zstd.NewReader(pr)
+		if err != nil {
+			w.Close()
+			pr.CloseWithError(err)
+			return
+		}
+
+		_, err = io.Copy(w, dec.IOReadCloser())
+		w.Close()
+		pr.CloseWithError(err)
+	}()
+
+	return pw
+}
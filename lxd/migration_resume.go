@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// migrationProgressState records, per snapshot/rootfs name, how far the
+// sink got receiving container's volume. It's persisted to disk so that a
+// WAN migration dropped mid-transfer can resume without re-sending
+// snapshots that already made it across: Completed names are skipped
+// outright on retry. Inflight only records which name was being received
+// when the attempt dropped - nothing currently reads it back to resume a
+// partial transfer, so that one name is simply resent from scratch, the
+// same as any name never attempted at all.
+type migrationProgressState struct {
+	Completed []string `json:"completed"`
+	Inflight  string   `json:"inflight"`
+}
+
+func migrationProgressPath(containerName string) string {
+	return shared.VarPath("migration", containerName+".progress")
+}
+
+// loadMigrationProgress returns the sink's prior progress for containerName,
+// or an empty state if this is the first attempt.
+func loadMigrationProgress(containerName string) *migrationProgressState {
+	data, err := ioutil.ReadFile(migrationProgressPath(containerName))
+	if err != nil {
+		return &migrationProgressState{}
+	}
+
+	state := &migrationProgressState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return &migrationProgressState{}
+	}
+
+	return state
+}
+
+func (s *migrationProgressState) isComplete(name string) bool {
+	for _, done := range s.Completed {
+		if done == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// markInflight records name as the snapshot/rootfs currently being
+// received. It's informational only: a retry still resends name in full
+// rather than resuming it partway through, the same as any name that was
+// never attempted.
+func (s *migrationProgressState) markInflight(containerName string, name string) {
+	s.Inflight = name
+	s.save(containerName)
+}
+
+// markComplete records name as fully received and clears it as in flight.
+func (s *migrationProgressState) markComplete(containerName string, name string) {
+	if s.Inflight == name {
+		s.Inflight = ""
+	}
+
+	if !s.isComplete(name) {
+		s.Completed = append(s.Completed, name)
+	}
+
+	s.save(containerName)
+}
+
+func (s *migrationProgressState) save(containerName string) {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return
+	}
+
+	os.MkdirAll(shared.VarPath("migration"), 0700)
+	ioutil.WriteFile(migrationProgressPath(containerName), data, 0600)
+}
+
+// clear removes the on-disk progress record after a successful migration.
+func (s *migrationProgressState) clear(containerName string) {
+	os.Remove(migrationProgressPath(containerName))
+}
@@ -0,0 +1,50 @@
+package main
+
+import "testing"
+
+func TestMigrationProgressStateTracksCompletionAndInflight(t *testing.T) {
+	s := &migrationProgressState{}
+
+	if s.isComplete("rootfs") {
+		t.Fatalf("fresh state should not report anything complete")
+	}
+
+	s.markInflight("c1", "snap1")
+	if s.Inflight != "snap1" {
+		t.Fatalf("got Inflight %q, want snap1", s.Inflight)
+	}
+
+	s.markComplete("c1", "snap1")
+	if s.Inflight != "" {
+		t.Fatalf("markComplete should clear Inflight for the name it completes")
+	}
+
+	if !s.isComplete("snap1") {
+		t.Fatalf("snap1 should be reported complete after markComplete")
+	}
+
+	// Completing the same name twice shouldn't duplicate the entry.
+	s.markComplete("c1", "snap1")
+	count := 0
+	for _, name := range s.Completed {
+		if name == "snap1" {
+			count++
+		}
+	}
+
+	if count != 1 {
+		t.Fatalf("got %d entries for snap1 in Completed, want 1", count)
+	}
+}
+
+func TestMigrationProgressStateIsCompleteOnlyMatchesKnownNames(t *testing.T) {
+	s := &migrationProgressState{Completed: []string{"rootfs", "snap1"}}
+
+	if !s.isComplete("rootfs") || !s.isComplete("snap1") {
+		t.Fatalf("expected both recorded names to be complete")
+	}
+
+	if s.isComplete("snap2") {
+		t.Fatalf("snap2 was never recorded as complete")
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"github.com/lxc/lxd/lxd/migration"
+	"github.com/lxc/lxd/shared"
+)
+
+// containerSeedFingerprints returns the fingerprint chain a container's
+// volume was derived from, oldest first: its base image (if any), followed
+// by its own snapshots in creation order. It is advertised to the sink in
+// the migration header so a destination that already has the same image
+// cached, or already holds a snapshot of this same container from an
+// earlier migration or copy, can seed its copy from whichever common
+// ancestor it has before rsync (or a native send/receive) runs.
+func containerSeedFingerprints(c container) []string {
+	fingerprints := []string{}
+
+	if image := c.ExpandedConfig()["volatile.base_image"]; image != "" {
+		fingerprints = append(fingerprints, image)
+	}
+
+	snapshots, err := c.Snapshots()
+	if err == nil {
+		for _, snap := range snapshots {
+			fingerprints = append(fingerprints, snap.Name())
+		}
+	}
+
+	return fingerprints
+}
+
+// localImageFingerprints filters candidates down to the ones already
+// cached on this host, in the same order, so they can be matched against a
+// source's advertised seed fingerprints with migration.PickSeed.
+func localImageFingerprints(candidates []string) []string {
+	local := make([]string, 0, len(candidates))
+	for _, fingerprint := range candidates {
+		if shared.PathExists(shared.VarPath("images", fingerprint)) {
+			local = append(local, fingerprint)
+		}
+	}
+
+	return local
+}
+
+// localSnapshotFingerprints returns the names of container's own snapshots
+// already present on the destination storage pool, so they can be matched
+// against a source's advertised seed fingerprints the same way
+// localImageFingerprints matches cached images. A hit here means container
+// already exists on this pool from an earlier migration or copy, so there
+// is nothing for preSeedVolume to unpack for it.
+func localSnapshotFingerprints(c container) []string {
+	snapshots, err := c.Snapshots()
+	if err != nil {
+		return nil
+	}
+
+	fingerprints := make([]string, len(snapshots))
+	for i, snap := range snapshots {
+		fingerprints[i] = snap.Name()
+	}
+
+	return fingerprints
+}
+
+// preSeedVolume materializes container's rootfs from the locally cached
+// image identified by fingerprint, so that the rsync (or incremental
+// send/receive) pass that follows only has to transfer the diff between
+// that image and the running source rather than the whole volume. It is a
+// no-op when fingerprint instead names one of container's own snapshots -
+// that data is already in place, there is nothing to unpack.
+func preSeedVolume(c container, fingerprint string) error {
+	imagePath := shared.VarPath("images", fingerprint)
+	if !shared.PathExists(imagePath) {
+		return nil
+	}
+
+	return unpackImage(imagePath, c.Path())
+}
+
+// pickSeed matches sourceFingerprints (as advertised by the source in the
+// migration header) against what's already available locally - cached
+// images and container's own snapshots alike - returning the best common
+// ancestor to seed container's volume from, if any.
+func pickSeed(sourceFingerprints []string, c container) (string, bool) {
+	if len(sourceFingerprints) == 0 {
+		return "", false
+	}
+
+	local := append(localImageFingerprints(sourceFingerprints), localSnapshotFingerprints(c)...)
+	return migration.PickSeed(sourceFingerprints, local)
+}
+
+// seedIsSnapshot reports whether fingerprint names one of container's own
+// snapshots rather than a cached image - i.e. whether pickSeed found a
+// common ancestor already on this storage pool rather than one
+// preSeedVolume can unpack.
+func seedIsSnapshot(c container, fingerprint string) bool {
+	for _, name := range localSnapshotFingerprints(c) {
+		if name == fingerprint {
+			return true
+		}
+	}
+
+	return false
+}
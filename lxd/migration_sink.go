@@ -0,0 +1,153 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+
+	"github.com/lxc/lxd/lxd/migration"
+	"github.com/lxc/lxd/shared"
+)
+
+// MigrationStorageSinkDriver receives the byte stream produced by a
+// MigrationStorageSourceDriver and lays it out according to its backend's
+// snapshot model. Unlike the source driver, which is picked once the
+// negotiated MigrationType is known, the sink driver is keyed purely off
+// the destination's own storage backend: even an rsync fallback transfer
+// needs to be laid out differently for, say, dir vs lvm.
+type MigrationStorageSinkDriver interface {
+	CreateVolumeFromMigration(live bool, container container, snapshots []*Snapshot, parentStoragePool string, migrationType MigrationType, conn *websocket.Conn, srcIdmap *shared.IdmapSet, progress *migrationProgressState, op *operation) error
+}
+
+// migrationSinkDriverForContainer returns the MigrationStorageSinkDriver
+// appropriate for container's storage backend.
+func migrationSinkDriverForContainer(container container) MigrationStorageSinkDriver {
+	switch container.Storage().GetStorageType() {
+	case storageTypeDir:
+		return dirMigrationSinkDriver{}
+	case storageTypeBtrfs:
+		return btrfsMigrationSinkDriver{}
+	case storageTypeZfs:
+		return zfsMigrationSinkDriver{}
+	default:
+		return genericMigrationSinkDriver{}
+	}
+}
+
+// assignSnapshotStoragePool ensures the snapshot's local root disk device
+// (if any) shares the parent container's storage pool. If the root disk
+// device for the snapshot comes from a profile on the new instance as well
+// we don't need to do anything.
+func assignSnapshotStoragePool(args containerArgs, parentStoragePool string) {
+	if args.Devices == nil {
+		return
+	}
+
+	snapLocalRootDiskDeviceKey, _, _ := containerGetRootDiskDevice(args.Devices)
+	if snapLocalRootDiskDeviceKey != "" {
+		args.Devices[snapLocalRootDiskDeviceKey]["pool"] = parentStoragePool
+	}
+}
+
+// dirMigrationSinkDriver lays out each incoming snapshot as its own
+// directory, created up-front as an empty snapshot container before rsync
+// populates it. This is the layout a dir backend's snapshots need, since
+// each one is a fully independent copy of the rootfs.
+type dirMigrationSinkDriver struct{}
+
+func (dirMigrationSinkDriver) CreateVolumeFromMigration(live bool, container container, snapshots []*Snapshot, parentStoragePool string, migrationType MigrationType, conn *websocket.Conn, srcIdmap *shared.IdmapSet, progress *migrationProgressState, op *operation) error {
+	for _, snap := range snapshots {
+		if progress.isComplete(snap.GetName()) {
+			continue
+		}
+
+		args := snapshotProtobufToContainerArgs(container.Name(), snap)
+		assignSnapshotStoragePool(args, parentStoragePool)
+
+		s, err := containerCreateEmptySnapshot(container.Daemon(), args)
+		if err != nil {
+			return err
+		}
+
+		progress.markInflight(container.Name(), snap.GetName())
+		wrapper := StorageProgressWriter(op, "fs_progress", s.Name())
+		if err := RsyncRecv(shared.AddSlash(s.Path()), conn, rsyncRecvWrapper(wrapper, migrationType)); err != nil {
+			return err
+		}
+		progress.markComplete(container.Name(), snap.GetName())
+
+		if err := ShiftIfNecessary(container, srcIdmap); err != nil {
+			return err
+		}
+	}
+
+	// The dir backend's snapshots are each a full, independent directory,
+	// which is exactly what sendVolume/recvVolume's shared rsync plumbing
+	// moves around for a plain MigrationVolume - so the final rootfs
+	// transfer goes through it directly rather than calling RsyncRecv
+	// itself.
+	targetArgs := migration.VolumeTargetArgs{Name: container.Name(), MigrationType: migrationType}
+
+	progress.markInflight(container.Name(), container.Name())
+	wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
+	if err := recvVolume(conn, targetArgs, container.Path(), wrapper); err != nil {
+		return err
+	}
+
+	if live {
+		wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
+		if err := recvVolume(conn, targetArgs, container.Path(), wrapper); err != nil {
+			return err
+		}
+	}
+
+	progress.markComplete(container.Name(), container.Name())
+	return ShiftIfNecessary(container, srcIdmap)
+}
+
+// genericMigrationSinkDriver is used by backends (lvm, ceph) that have no
+// native send/receive support and can't materialize an empty snapshot
+// placeholder ahead of time: each snapshot is rsynced straight into the
+// container's own path and then captured as a snapshot afterwards.
+type genericMigrationSinkDriver struct{}
+
+func (genericMigrationSinkDriver) CreateVolumeFromMigration(live bool, container container, snapshots []*Snapshot, parentStoragePool string, migrationType MigrationType, conn *websocket.Conn, srcIdmap *shared.IdmapSet, progress *migrationProgressState, op *operation) error {
+	for _, snap := range snapshots {
+		if progress.isComplete(snap.GetName()) {
+			continue
+		}
+
+		args := snapshotProtobufToContainerArgs(container.Name(), snap)
+		assignSnapshotStoragePool(args, parentStoragePool)
+
+		progress.markInflight(container.Name(), snap.GetName())
+		wrapper := StorageProgressWriter(op, "fs_progress", snap.GetName())
+		if err := RsyncRecv(shared.AddSlash(container.Path()), conn, rsyncRecvWrapper(wrapper, migrationType)); err != nil {
+			return err
+		}
+
+		if err := ShiftIfNecessary(container, srcIdmap); err != nil {
+			return err
+		}
+
+		if _, err := containerCreateAsSnapshot(container.Daemon(), args, container); err != nil {
+			return err
+		}
+
+		progress.markComplete(container.Name(), snap.GetName())
+	}
+
+	progress.markInflight(container.Name(), container.Name())
+	wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
+	if err := RsyncRecv(shared.AddSlash(container.Path()), conn, rsyncRecvWrapper(wrapper, migrationType)); err != nil {
+		return err
+	}
+
+	if live {
+		wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
+		if err := RsyncRecv(shared.AddSlash(container.Path()), conn, rsyncRecvWrapper(wrapper, migrationType)); err != nil {
+			return err
+		}
+	}
+
+	progress.markComplete(container.Name(), container.Name())
+	return ShiftIfNecessary(container, srcIdmap)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"io"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/lxc/lxd/lxd/migration"
+	"github.com/lxc/lxd/shared"
+)
+
+// sendVolume rsyncs a MigrationVolume - a root path plus zero or more named
+// snapshot paths, in migration order - across conn. It is the rsync
+// transport's shared plumbing underneath both container rootfs migration
+// and bare custom storage volume migration via MigrateVolume; callers
+// needing container semantics (idmap shift, stateful checkpoint, root disk
+// device lookup) layer those on top.
+//
+// Snapshot names listed in args.ResumeSkip are omitted entirely rather than
+// resent: the sink already received them in full during an earlier,
+// dropped attempt at this same migration, and it skips the matching receive
+// call for them, so sending their frames here would desync the two ends'
+// view of the websocket stream. The rootfs is always sent, since the sink
+// always receives it.
+func sendVolume(conn *websocket.Conn, args migration.VolumeSourceArgs, rootPath string, snapshotPaths []string, op *operation) error {
+	vol := args.Volume()
+	skip := make(map[string]bool, len(args.ResumeSkip))
+	for _, name := range args.ResumeSkip {
+		skip[name] = true
+	}
+
+	for i, path := range snapshotPaths {
+		name := vol.Snapshots[i]
+		if skip[name] {
+			continue
+		}
+
+		progress := StorageProgressReader(op, "fs_progress", name)
+		if err := RsyncSend(shared.AddSlash(path), conn, rsyncSendWrapper(progress, args.MigrationType)); err != nil {
+			return err
+		}
+	}
+
+	progress := StorageProgressReader(op, "fs_progress", vol.Name)
+	return RsyncSend(shared.AddSlash(rootPath), conn, rsyncSendWrapper(progress, args.MigrationType))
+}
+
+// recvVolume is the receive-side counterpart to sendVolume. args.Snapshots
+// isn't consulted here: each snapshot in a MigrationVolume lands at its own
+// path chosen by the caller (an empty snapshot container, a zfs dataset,
+// ...), so callers walk args.Volume().Snapshots themselves and call
+// recvVolume once per path; this call handles just the one rootPath given to
+// it, which is usually the volume's own root.
+func recvVolume(conn *websocket.Conn, args migration.VolumeTargetArgs, rootPath string, wrapper func(io.WriteCloser) io.WriteCloser) error {
+	return RsyncRecv(shared.AddSlash(rootPath), conn, rsyncRecvWrapper(wrapper, args.MigrationType))
+}
+
+// MigrateVolume sends a storage volume across conn using sendVolume, with no
+// container involved at either end - just as migration.VolumeSourceArgs
+// promises. It exists to prove that promise rather than to deliver
+// `lxc storage volume copy` on its own: nothing in this tree yet calls it -
+// there is no API route or CLI command wired up to do so.
+func MigrateVolume(conn *websocket.Conn, args migration.VolumeSourceArgs, rootPath string, snapshotPaths []string) error {
+	return sendVolume(conn, args, rootPath, snapshotPaths, nil)
+}
+
+// ReceiveVolume is the receive-side counterpart to MigrateVolume.
+func ReceiveVolume(conn *websocket.Conn, args migration.VolumeTargetArgs, rootPath string, wrapper func(io.WriteCloser) io.WriteCloser) error {
+	return recvVolume(conn, args, rootPath, wrapper)
+}
+
+// rsyncSendWrapper composes progress with migrationType's bandwidth limit
+// and, if both ends negotiated the "compress" feature, zstd compression,
+// applied in the same order migrationSendFile uses for the native
+// transports: progress sees the raw bytes read locally, compression runs
+// next, and the bandwidth limit caps the (possibly smaller) compressed
+// stream RsyncSend actually hands off to the connection.
+func rsyncSendWrapper(progress func(io.ReadCloser) io.ReadCloser, migrationType migration.Type) func(io.ReadCloser) io.ReadCloser {
+	return func(r io.ReadCloser) io.ReadCloser {
+		if progress != nil {
+			r = progress(r)
+		}
+
+		compressed := maybeCompressReader(r, migrationType.HasFeature("compress"))
+		limited := newBwlimitReader(compressed, migrationType.BwlimitBytesPerSecond)
+		return limitedReadCloser{limited, compressed}
+	}
+}
+
+// limitedReadCloser pairs a (possibly rate-limited) Reader with the
+// ReadCloser it wraps, so closing it still closes the underlying stream.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// rsyncRecvWrapper is the receive-side counterpart to rsyncSendWrapper.
+// There's no bandwidth limit here - the sender already throttles what it
+// writes, so limiting again on read would just add latency - only
+// decompression, which runs first on the bytes RsyncRecv writes locally, so
+// progress sees the decompressed bytes, mirroring rsyncSendWrapper.
+func rsyncRecvWrapper(progress func(io.WriteCloser) io.WriteCloser, migrationType migration.Type) func(io.WriteCloser) io.WriteCloser {
+	return func(w io.WriteCloser) io.WriteCloser {
+		if progress != nil {
+			w = progress(w)
+		}
+
+		return maybeDecompressWriter(w, migrationType.HasFeature("compress"))
+	}
+}
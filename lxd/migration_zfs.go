@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/lxc/lxd/shared"
+)
+
+// zfsMigrationSourceDriver streams zfs datasets natively via
+// `zfs send`/`zfs receive` instead of rsync. SendWhileRunning sends a full
+// stream from a base snapshot taken up-front; SendAfterCheckpoint sends an
+// incremental `-i` delta from that same snapshot.
+type zfsMigrationSourceDriver struct {
+	container       container
+	snapshots       []container
+	zfs             *storageZfs
+	migrationType   MigrationType
+	runningSnapName string
+	stoppedSnapName string
+
+	// resumeSkip lists snapshot names the sink already received in full
+	// during an earlier, dropped attempt at this same migration; they're
+	// omitted here to match the sink's own skip in migration_zfs.go.
+	resumeSkip []string
+}
+
+func (s *zfsMigrationSourceDriver) Snapshots() []container {
+	return s.snapshots
+}
+
+func (s *zfsMigrationSourceDriver) SendWhileRunning(conn *websocket.Conn, op *operation) error {
+	skip := make(map[string]bool, len(s.resumeSkip))
+	for _, name := range s.resumeSkip {
+		skip[name] = true
+	}
+
+	for _, snap := range s.snapshots {
+		if skip[snap.Name()] {
+			continue
+		}
+
+		wrapper := StorageProgressReader(op, "fs_progress", snap.Name())
+		if err := s.send(conn, s.zfs.zfsDataset(snap), "", wrapper); err != nil {
+			return err
+		}
+	}
+
+	// Take a snapshot of the dataset so the post-checkpoint send in
+	// SendAfterCheckpoint has a stable base to diff against.
+	s.runningSnapName = fmt.Sprintf("migration-send-%s", s.container.Name())
+	if err := s.zfs.zfsSnapshotCreate(s.zfs.zfsDataset(s.container), s.runningSnapName); err != nil {
+		return err
+	}
+
+	wrapper := StorageProgressReader(op, "fs_progress", s.container.Name())
+	return s.send(conn, s.zfs.zfsDataset(s.container), s.runningSnapName, wrapper)
+}
+
+// SendAfterCheckpoint is idempotent: on a retried migration (e.g. after a
+// dropped WAN connection) it may be called again for the same checkpoint,
+// so any snapshot left over from a prior attempt is destroyed first rather
+// than erroring out on a name collision.
+func (s *zfsMigrationSourceDriver) SendAfterCheckpoint(conn *websocket.Conn) error {
+	s.stoppedSnapName = fmt.Sprintf("migration-send-%s-final", s.container.Name())
+	s.zfs.zfsSnapshotDestroy(s.zfs.zfsDataset(s.container), s.stoppedSnapName)
+	if err := s.zfs.zfsSnapshotCreate(s.zfs.zfsDataset(s.container), s.stoppedSnapName); err != nil {
+		return err
+	}
+
+	return s.sendIncremental(conn, s.zfs.zfsDataset(s.container), s.runningSnapName, s.stoppedSnapName)
+}
+
+func (s *zfsMigrationSourceDriver) Cleanup() {
+	if s.runningSnapName != "" {
+		s.zfs.zfsSnapshotDestroy(s.zfs.zfsDataset(s.container), s.runningSnapName)
+	}
+
+	if s.stoppedSnapName != "" {
+		s.zfs.zfsSnapshotDestroy(s.zfs.zfsDataset(s.container), s.stoppedSnapName)
+	}
+}
+
+// send pipes `zfs send [dataset@snapshot]` into conn, either as a full
+// stream (snapName == "") or as the full contents as of snapName.
+func (s *zfsMigrationSourceDriver) send(conn *websocket.Conn, dataset string, snapName string, wrapper func(io.ReadCloser) io.ReadCloser) error {
+	source := dataset
+	if snapName != "" {
+		source = fmt.Sprintf("%s@%s", dataset, snapName)
+	}
+
+	return s.run(conn, exec.Command("zfs", "send", source), wrapper)
+}
+
+// sendIncremental pipes `zfs send -i fromSnap toSnap` into conn.
+func (s *zfsMigrationSourceDriver) sendIncremental(conn *websocket.Conn, dataset string, fromSnap string, toSnap string) error {
+	from := fmt.Sprintf("%s@%s", dataset, fromSnap)
+	to := fmt.Sprintf("%s@%s", dataset, toSnap)
+
+	return s.run(conn, exec.Command("zfs", "send", "-i", from, to), nil)
+}
+
+func (s *zfsMigrationSourceDriver) run(conn *websocket.Conn, cmd *exec.Cmd, wrapper func(io.ReadCloser) io.ReadCloser) error {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var reader io.ReadCloser = stdout
+	if wrapper != nil {
+		reader = wrapper(stdout)
+	}
+
+	if err := migrationSendFile(conn, reader, s.migrationType); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	return cmd.Wait()
+}
+
+func zfsMigrationSource(c container, snapshots []container, migrationType MigrationType, resumeSkip []string) (MigrationStorageSourceDriver, error) {
+	zfs, ok := c.Storage().(*storageZfs)
+	if !ok {
+		return nil, fmt.Errorf("Container is not backed by a zfs pool")
+	}
+
+	return &zfsMigrationSourceDriver{container: c, snapshots: snapshots, zfs: zfs, migrationType: migrationType, resumeSkip: resumeSkip}, nil
+}
+
+// zfsMigrationSinkDriver lays out incoming snapshots as zfs datasets when
+// the negotiated transport is native send/receive, and otherwise defers to
+// the generic rsync layout used by backends with no native send/receive
+// support.
+type zfsMigrationSinkDriver struct{}
+
+func (zfsMigrationSinkDriver) CreateVolumeFromMigration(live bool, container container, snapshots []*Snapshot, parentStoragePool string, migrationType MigrationType, conn *websocket.Conn, srcIdmap *shared.IdmapSet, progress *migrationProgressState, op *operation) error {
+	if migrationType.FSType != MigrationFSType_ZFS {
+		return genericMigrationSinkDriver{}.CreateVolumeFromMigration(live, container, snapshots, parentStoragePool, migrationType, conn, srcIdmap, progress, op)
+	}
+
+	zfs, ok := container.Storage().(*storageZfs)
+	if !ok {
+		return fmt.Errorf("Container is not backed by a zfs pool")
+	}
+
+	for _, snap := range snapshots {
+		if progress.isComplete(snap.GetName()) {
+			continue
+		}
+
+		args := snapshotProtobufToContainerArgs(container.Name(), snap)
+		assignSnapshotStoragePool(args, parentStoragePool)
+
+		s, err := containerCreateEmptySnapshot(container.Daemon(), args)
+		if err != nil {
+			return err
+		}
+
+		progress.markInflight(container.Name(), snap.GetName())
+		wrapper := StorageProgressWriter(op, "fs_progress", s.Name())
+		if err := zfsMigrationSink(conn, zfs.zfsDataset(s), migrationType, wrapper); err != nil {
+			return err
+		}
+		progress.markComplete(container.Name(), snap.GetName())
+
+		if err := ShiftIfNecessary(container, srcIdmap); err != nil {
+			return err
+		}
+	}
+
+	progress.markInflight(container.Name(), container.Name())
+	wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
+	if err := zfsMigrationSink(conn, zfs.zfsDataset(container), migrationType, wrapper); err != nil {
+		return err
+	}
+
+	if live {
+		// SendAfterCheckpoint sent an incremental `zfs send -i` delta
+		// based on the snapshot the full receive above just created at
+		// zfs.zfsDataset(container). `zfs receive -F` applies an
+		// incremental stream in place against that snapshot (matched by
+		// the GUID embedded in the stream, not by name), rolling the
+		// dataset forward to the new checkpoint, so this call really
+		// does apply the delta rather than repeating the full receive.
+		wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
+		if err := zfsMigrationSink(conn, zfs.zfsDataset(container), migrationType, wrapper); err != nil {
+			return err
+		}
+	}
+
+	progress.markComplete(container.Name(), container.Name())
+	return ShiftIfNecessary(container, srcIdmap)
+}
+
+// zfsMigrationSink creates the receiving dataset up-front and pipes the
+// incoming stream into `zfs receive`.
+func zfsMigrationSink(conn *websocket.Conn, destDataset string, migrationType MigrationType, wrapper func(io.WriteCloser) io.WriteCloser) error {
+	cmd := exec.Command("zfs", "receive", "-F", destDataset)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	var writer io.WriteCloser = stdin
+	if wrapper != nil {
+		writer = wrapper(stdin)
+	}
+
+	if err := migrationRecvFile(conn, writer, migrationType); err != nil {
+		cmd.Process.Kill()
+		return err
+	}
+
+	writer.Close()
+	return cmd.Wait()
+}
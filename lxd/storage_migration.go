@@ -5,6 +5,7 @@ import (
 
 	"github.com/gorilla/websocket"
 
+	"github.com/lxc/lxd/lxd/migration"
 	"github.com/lxc/lxd/lxd/types"
 	"github.com/lxc/lxd/shared"
 )
@@ -34,6 +35,16 @@ type MigrationStorageSourceDriver interface {
 type rsyncStorageSourceDriver struct {
 	container container
 	snapshots []container
+
+	// resumeSkip lists snapshot/rootfs names the sink already told us (via
+	// the migration header) it received in full during an earlier,
+	// dropped attempt at this same migration. SendWhileRunning still
+	// builds the full Snapshots list below so progress reporting and
+	// ordering stay unchanged, but sendVolume skips the frames for the
+	// snapshot names among these so the sink's matching skip in
+	// migration_sink.go doesn't
+	// desync the two ends' view of the websocket stream.
+	resumeSkip []string
 }
 
 func (s rsyncStorageSourceDriver) Snapshots() []container {
@@ -41,39 +52,48 @@ func (s rsyncStorageSourceDriver) Snapshots() []container {
 }
 
 func (s rsyncStorageSourceDriver) SendWhileRunning(conn *websocket.Conn, op *operation) error {
-	for _, send := range s.snapshots {
+	args := migration.VolumeSourceArgs{
+		Name:          s.container.Name(),
+		MigrationType: MigrationType{FSType: MigrationFSType_RSYNC},
+		Fingerprints:  containerSeedFingerprints(s.container),
+		ResumeSkip:    s.resumeSkip,
+	}
+
+	snapshotPaths := make([]string, len(s.snapshots))
+	for i, send := range s.snapshots {
 		if err := send.StorageStart(); err != nil {
 			return err
 		}
 		defer send.StorageStop()
 
-		path := send.Path()
-		wrapper := StorageProgressReader(op, "fs_progress", send.Name())
-		if err := RsyncSend(shared.AddSlash(path), conn, wrapper); err != nil {
-			return err
-		}
+		args.Snapshots = append(args.Snapshots, send.Name())
+		snapshotPaths[i] = send.Path()
 	}
 
-	wrapper := StorageProgressReader(op, "fs_progress", s.container.Name())
-	return RsyncSend(shared.AddSlash(s.container.Path()), conn, wrapper)
+	return sendVolume(conn, args, s.container.Path(), snapshotPaths, op)
 }
 
 func (s rsyncStorageSourceDriver) SendAfterCheckpoint(conn *websocket.Conn) error {
 	/* resync anything that changed between our first send and the checkpoint */
-	return RsyncSend(shared.AddSlash(s.container.Path()), conn, nil)
+	args := migration.VolumeSourceArgs{
+		Name:          s.container.Name(),
+		MigrationType: MigrationType{FSType: MigrationFSType_RSYNC},
+	}
+
+	return sendVolume(conn, args, s.container.Path(), nil, nil)
 }
 
 func (s rsyncStorageSourceDriver) Cleanup() {
 	/* no-op */
 }
 
-func rsyncMigrationSource(container container) (MigrationStorageSourceDriver, error) {
+func rsyncMigrationSource(container container, resumeSkip []string) (MigrationStorageSourceDriver, error) {
 	snapshots, err := container.Snapshots()
 	if err != nil {
 		return nil, err
 	}
 
-	return rsyncStorageSourceDriver{container, snapshots}, nil
+	return rsyncStorageSourceDriver{container, snapshots, resumeSkip}, nil
 }
 
 func snapshotProtobufToContainerArgs(containerName string, snap *Snapshot) containerArgs {
@@ -106,7 +126,16 @@ func snapshotProtobufToContainerArgs(containerName string, snap *Snapshot) conta
 	}
 }
 
-func rsyncMigrationSink(live bool, container container, snapshots []*Snapshot, conn *websocket.Conn, srcIdmap *shared.IdmapSet, op *operation) error {
+// migrationSink is the sink-side entry point for container migration. It is
+// authoritative over transport choice: it inspects its own storage backend's
+// capabilities, intersects them with the source's advertised MigrationTypes,
+// and asks the source to fall back to rsync when the two ends don't share a
+// native transport - even if the source's local backend natively supports
+// send/receive. bwlimitBytesPerSecond is similarly the sink's call: it's
+// stamped onto the sink's own candidate Types so the negotiated Type carries
+// it back to both the source and the sink's own migration_types.go transport
+// helpers.
+func migrationSink(live bool, container container, snapshots []*Snapshot, sourceTypes []MigrationType, sourceFingerprints []string, bwlimitBytesPerSecond int64, conn *websocket.Conn, srcIdmap *shared.IdmapSet, op *operation) error {
 	if err := container.StorageStart(); err != nil {
 		return err
 	}
@@ -127,90 +156,46 @@ func rsyncMigrationSink(live bool, container container, snapshots []*Snapshot, c
 		return fmt.Errorf("The container's root device is missing the pool property.")
 	}
 
-	isDirBackend := container.Storage().GetStorageType() == storageTypeDir
-	if isDirBackend {
-		for _, snap := range snapshots {
-			args := snapshotProtobufToContainerArgs(container.Name(), snap)
-
-			// Ensure that snapshot and parent container have the
-			// same storage pool in their local root disk device.
-			// If the root disk device for the snapshot comes from a
-			// profile on the new instance as well we don't need to
-			// do anything.
-			if args.Devices != nil {
-				snapLocalRootDiskDeviceKey, _, _ := containerGetRootDiskDevice(args.Devices)
-				if snapLocalRootDiskDeviceKey != "" {
-					args.Devices[snapLocalRootDiskDeviceKey]["pool"] = parentStoragePool
-				}
-			}
-
-			s, err := containerCreateEmptySnapshot(container.Daemon(), args)
-			if err != nil {
-				return err
-			}
-
-			wrapper := StorageProgressWriter(op, "fs_progress", s.Name())
-			if err := RsyncRecv(shared.AddSlash(s.Path()), conn, wrapper); err != nil {
-				return err
-			}
-
-			if err := ShiftIfNecessary(container, srcIdmap); err != nil {
-				return err
-			}
-		}
+	migrationType, ok := matchMigrationType(sourceTypes, sourceMigrationTypes(container.Storage().GetStorageType(), bwlimitBytesPerSecond))
+	if !ok {
+		// The two backends share no native transport (e.g. a zfs
+		// source talking to a dir or lvm sink): fall back to rsync,
+		// which every backend understands.
+		migrationType = migrationTypeFromStorageType(storageTypeDir, bwlimitBytesPerSecond)
+	}
 
-		wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
-		if err := RsyncRecv(shared.AddSlash(container.Path()), conn, wrapper); err != nil {
-			return err
-		}
-	} else {
-		for _, snap := range snapshots {
-			args := snapshotProtobufToContainerArgs(container.Name(), snap)
-
-			// Ensure that snapshot and parent container have the
-			// same storage pool in their local root disk device.
-			// If the root disk device for the snapshot comes from a
-			// profile on the new instance as well we don't need to
-			// do anything.
-			if args.Devices != nil {
-				snapLocalRootDiskDeviceKey, _, _ := containerGetRootDiskDevice(args.Devices)
-				if snapLocalRootDiskDeviceKey != "" {
-					args.Devices[snapLocalRootDiskDeviceKey]["pool"] = parentStoragePool
+	// If the source already told us it derives this volume from an image
+	// we happen to have cached, pre-seed the volume from it so only the
+	// diff crosses the wire. If instead the common ancestor is one of
+	// container's own snapshots already on this pool (e.g. a previous,
+	// dropped migration or an earlier copy), there's nothing to pre-seed -
+	// the data's already here - and our native transport is used as long
+	// as the source offers it too. The source drivers do not send an
+	// incremental diff based on that snapshot: snapshots and the rootfs
+	// still cross the wire in full.
+	if seed, ok := pickSeed(sourceFingerprints, container); ok {
+		if seedIsSnapshot(container, seed) {
+			native := migrationTypeFromStorageType(container.Storage().GetStorageType(), bwlimitBytesPerSecond)
+			for _, sourceType := range sourceTypes {
+				if native.FSType != MigrationFSType_RSYNC && sourceType.FSType == native.FSType {
+					migrationType = native
 				}
 			}
-
-			wrapper := StorageProgressWriter(op, "fs_progress", snap.GetName())
-			if err := RsyncRecv(shared.AddSlash(container.Path()), conn, wrapper); err != nil {
-				return err
-			}
-
-			if err := ShiftIfNecessary(container, srcIdmap); err != nil {
-				return err
-			}
-
-			_, err := containerCreateAsSnapshot(container.Daemon(), args, container)
-			if err != nil {
-				return err
-			}
-		}
-
-		wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
-		if err := RsyncRecv(shared.AddSlash(container.Path()), conn, wrapper); err != nil {
+		} else if err := preSeedVolume(container, seed); err != nil {
 			return err
 		}
 	}
 
-	if live {
-		/* now receive the final sync */
-		wrapper := StorageProgressWriter(op, "fs_progress", container.Name())
-		if err := RsyncRecv(shared.AddSlash(container.Path()), conn, wrapper); err != nil {
-			return err
-		}
-	}
+	// Resume support: pick up wherever a previous, dropped attempt at
+	// this migration left off rather than re-transferring snapshots that
+	// already made it across.
+	progress := loadMigrationProgress(container.Name())
 
-	if err := ShiftIfNecessary(container, srcIdmap); err != nil {
+	driver := migrationSinkDriverForContainer(container)
+	if err := driver.CreateVolumeFromMigration(live, container, snapshots, parentStoragePool, migrationType, conn, srcIdmap, progress, op); err != nil {
 		return err
 	}
 
+	progress.clear(container.Name())
 	return nil
 }